@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// esBulkActionMeta is the per-line metadata object that precedes each
+// document in the NDJSON bulk format, e.g. {"index":{"_index":"logs","_id":"1"}}.
+type esBulkActionMeta struct {
+	Index string `json:"_index,omitempty"`
+	ID    string `json:"_id,omitempty"`
+}
+
+type esBulkAction struct {
+	Index  *esBulkActionMeta `json:"index,omitempty"`
+	Create *esBulkActionMeta `json:"create,omitempty"`
+	Update *esBulkActionMeta `json:"update,omitempty"`
+	Delete *esBulkActionMeta `json:"delete,omitempty"`
+}
+
+// actionType returns the ES action name ("index", "create", "update" or
+// "delete"), its metadata, and whether that action is followed by a
+// source-document line. index/create/update all carry a document; delete
+// does not, since there's nothing to index.
+func (a *esBulkAction) actionType() (string, *esBulkActionMeta, bool) {
+	switch {
+	case a.Create != nil:
+		return "create", a.Create, true
+	case a.Update != nil:
+		return "update", a.Update, true
+	case a.Delete != nil:
+		return "delete", a.Delete, false
+	default:
+		return "index", a.Index, true
+	}
+}
+
+type esBulkItem struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id,omitempty"`
+	Status int    `json:"status"`
+	Result string `json:"result,omitempty"`
+}
+
+type esBulkResponse struct {
+	Took   int64                   `json:"took"`
+	Errors bool                    `json:"errors"`
+	Items  []map[string]esBulkItem `json:"items"`
+}
+
+// ElasticsearchRouter returns the handler that backs --es-mode, emulating
+// just enough of the Elasticsearch HTTP surface (handshake, bulk, and
+// single-document indexing) for log shippers like Fluent Bit, Logstash,
+// Beats, and Vector's elasticsearch sink to treat this server as a drop-in
+// cluster.
+func (s *Server) ElasticsearchRouter() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/")
+
+		switch {
+		case r.URL.Path == "/" && r.Method == http.MethodGet:
+			s.esHandshake(w, r)
+		case r.URL.Path == "/" && r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case path == "_bulk" && r.Method == http.MethodPost:
+			s.esBulk(w, r, "")
+		case strings.HasSuffix(path, "/_bulk") && r.Method == http.MethodPost:
+			s.esBulk(w, r, strings.TrimSuffix(path, "/_bulk"))
+		case strings.HasSuffix(path, "/_doc") && r.Method == http.MethodPost:
+			s.esDoc(w, r, strings.TrimSuffix(path, "/_doc"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (s *Server) esHandshake(w http.ResponseWriter, r *http.Request) {
+	meta := ESMeta{Version: &ESVersion{Number: s.esVersion}}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+func (s *Server) esBulk(w http.ResponseWriter, r *http.Request, defaultIndex string) {
+	start := time.Now()
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Printf("Error reading bulk body: %v", err)
+		http.Error(w, "can't read body", http.StatusBadRequest)
+		return
+	}
+
+	lines := strings.Split(strings.TrimRight(string(bodyBytes), "\n"), "\n")
+
+	items := []map[string]esBulkItem{}
+	documents := []string{}
+
+	for i := 0; i < len(lines); {
+		var action esBulkAction
+		if err := json.Unmarshal([]byte(lines[i]), &action); err != nil {
+			s.logger.Printf("Error parsing bulk action: %v", err)
+			i++
+			continue
+		}
+
+		actionType, meta, hasDocument := action.actionType()
+		index := defaultIndex
+		id := ""
+		if meta != nil {
+			if meta.Index != "" {
+				index = meta.Index
+			}
+			id = meta.ID
+		}
+
+		items = append(items, map[string]esBulkItem{
+			actionType: {
+				Index:  index,
+				ID:     id,
+				Status: http.StatusCreated,
+				Result: "created",
+			},
+		})
+
+		if !hasDocument {
+			i++
+			continue
+		}
+
+		if i+1 < len(lines) {
+			documents = append(documents, lines[i+1])
+		}
+		i += 2
+	}
+
+	s.recordBatch(r.Header.Get("Content-Type"), documents)
+
+	resp := esBulkResponse{
+		Took:   time.Since(start).Milliseconds(),
+		Errors: false,
+		Items:  items,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) esDoc(w http.ResponseWriter, r *http.Request, index string) {
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Printf("Error reading document body: %v", err)
+		http.Error(w, "can't read body", http.StatusBadRequest)
+		return
+	}
+
+	s.recordBatch(r.Header.Get("Content-Type"), []string{string(bodyBytes)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(esBulkItem{
+		Index:  index,
+		Status: http.StatusCreated,
+		Result: "created",
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEsBulkActionActionType(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     esBulkAction
+		wantType   string
+		wantMeta   *esBulkActionMeta
+		wantHasDoc bool
+	}{
+		{
+			name:       "index",
+			action:     esBulkAction{Index: &esBulkActionMeta{ID: "1"}},
+			wantType:   "index",
+			wantMeta:   &esBulkActionMeta{ID: "1"},
+			wantHasDoc: true,
+		},
+		{
+			name:       "create",
+			action:     esBulkAction{Create: &esBulkActionMeta{ID: "2"}},
+			wantType:   "create",
+			wantMeta:   &esBulkActionMeta{ID: "2"},
+			wantHasDoc: true,
+		},
+		{
+			name:       "update",
+			action:     esBulkAction{Update: &esBulkActionMeta{ID: "3"}},
+			wantType:   "update",
+			wantMeta:   &esBulkActionMeta{ID: "3"},
+			wantHasDoc: true,
+		},
+		{
+			name:       "delete has no following document",
+			action:     esBulkAction{Delete: &esBulkActionMeta{ID: "4"}},
+			wantType:   "delete",
+			wantMeta:   &esBulkActionMeta{ID: "4"},
+			wantHasDoc: false,
+		},
+		{
+			name:       "empty action defaults to index",
+			action:     esBulkAction{},
+			wantType:   "index",
+			wantMeta:   nil,
+			wantHasDoc: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotType, gotMeta, gotHasDoc := tt.action.actionType()
+			if gotType != tt.wantType {
+				t.Errorf("actionType() type = %q, want %q", gotType, tt.wantType)
+			}
+			switch {
+			case gotMeta == nil && tt.wantMeta == nil:
+			case gotMeta == nil || tt.wantMeta == nil:
+				t.Errorf("actionType() meta = %v, want %v", gotMeta, tt.wantMeta)
+			case *gotMeta != *tt.wantMeta:
+				t.Errorf("actionType() meta = %+v, want %+v", *gotMeta, *tt.wantMeta)
+			}
+			if gotHasDoc != tt.wantHasDoc {
+				t.Errorf("actionType() hasDocument = %v, want %v", gotHasDoc, tt.wantHasDoc)
+			}
+		})
+	}
+}
+
+// TestEsBulkDeleteDoesNotConsumeNextLine guards against the bulk loop
+// treating a subsequent action line as the preceding delete's document,
+// which desyncs every item after a non-trailing delete.
+func TestEsBulkDeleteDoesNotConsumeNextLine(t *testing.T) {
+	server := NewServer(ServerConfig{Address: ":0"})
+
+	body := strings.Join([]string{
+		`{"delete":{"_id":"1"}}`,
+		`{"delete":{"_id":"2"}}`,
+		`{"index":{"_id":"3"}}`,
+		`{"field":"doc3"}`,
+	}, "\n") + "\n"
+
+	req := httptest.NewRequest("POST", "/_bulk", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	server.esBulk(rec, req, "")
+
+	var resp esBulkResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	wantActions := []string{"delete", "delete", "index"}
+	if len(resp.Items) != len(wantActions) {
+		t.Fatalf("got %d items, want %d", len(resp.Items), len(wantActions))
+	}
+	for i, want := range wantActions {
+		if _, ok := resp.Items[i][want]; !ok {
+			t.Errorf("item %d = %v, want a %q entry", i, resp.Items[i], want)
+		}
+	}
+
+	if got := atomic.LoadInt64(&server.MessageCount); got != 1 {
+		t.Errorf("MessageCount = %d, want 1 (only the index action carries a document)", got)
+	}
+}
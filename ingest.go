@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// maxScanTokenSize raises bufio.Scanner's default 64 KiB buffer so a
+// single NDJSON line up to 16 MiB (a large log line or stack trace) does
+// not trip bufio.ErrTooLong.
+const maxScanTokenSize = 16 * 1024 * 1024
+
+// ingest streams a request body into the running counters without
+// buffering it in full, so multi-megabyte batches from Fluent Bit/Vector
+// don't pin the whole payload in memory. Unrecognized content types are
+// drained and discarded, matching the prior read-the-whole-body behavior
+// without counting anything towards the summary.
+func (s *Server) ingest(contentType string, body io.Reader) error {
+	switch contentType {
+	case "application/ndjson", "application/x-ndjson", "text/plain":
+		return s.scanNDJSON(contentType, body)
+	case "application/json":
+		// Unfortunately fluentbit does not use the proper content type when
+		// sending new line delimited JSON, so this is almost always NDJSON in
+		// disguise; a well-formed application/json body (a stream of
+		// concatenated objects/arrays) is still supported as a fallback.
+		return s.ingestAmbiguousJSON(contentType, body)
+	default:
+		_, err := io.Copy(ioutil.Discard, body)
+		return err
+	}
+}
+
+// scanNDJSON records one message per line.
+func (s *Server) scanNDJSON(contentType string, body io.Reader) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxScanTokenSize)
+
+	for scanner.Scan() {
+		s.recordMessage(contentType, scanner.Text())
+	}
+
+	return scanner.Err()
+}
+
+// ingestAmbiguousJSON peeks at the first line of an application/json body
+// to tell NDJSON-mislabeled-as-json apart from a genuine JSON body, then
+// dispatches to the matching decoder.
+func (s *Server) ingestAmbiguousJSON(contentType string, body io.Reader) error {
+	reader := bufio.NewReaderSize(body, 64*1024)
+
+	firstLine, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	rest := io.MultiReader(strings.NewReader(firstLine), reader)
+
+	if json.Valid([]byte(strings.TrimRight(firstLine, "\r\n"))) {
+		return s.scanNDJSON(contentType, rest)
+	}
+
+	return s.decodeJSONStream(contentType, rest)
+}
+
+// decodeJSONStream consumes a stream of concatenated JSON objects/arrays
+// (no line-delimiting guaranteed), recording each decoded value as one
+// message.
+func (s *Server) decodeJSONStream(contentType string, body io.Reader) error {
+	dec := json.NewDecoder(body)
+
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		s.recordMessage(contentType, string(raw))
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// BenchmarkIndexNDJSON100MB locks in the streaming ingestion path from
+// pinning a 100 MB request body in memory.
+func BenchmarkIndexNDJSON100MB(b *testing.B) {
+	const targetSize = 100 * 1024 * 1024
+	const line = `{"level":"info","msg":"the quick brown fox jumps over the lazy dog","ts":1690000000}` + "\n"
+
+	var buf bytes.Buffer
+	buf.Grow(targetSize + len(line))
+	for buf.Len() < targetSize {
+		buf.WriteString(line)
+	}
+	payload := buf.Bytes()
+
+	server := NewServer(ServerConfig{Address: ":0"})
+	handler := server.Index()
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+	}
+}
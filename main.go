@@ -0,0 +1,29 @@
+package main
+
+import "flag"
+
+func main() {
+	address := flag.String("address", ":8080", "address to listen on")
+	esMode := flag.Bool("es-mode", false, "emulate the Elasticsearch bulk API instead of the default ingestion endpoint")
+	esVersion := flag.String("es-version", "7.10.2", "Elasticsearch version string reported by the handshake in --es-mode")
+	profile := flag.String("profile", "", "path to a YAML or JSON response/fault injection profile (see POST /_control/profile to swap it at runtime)")
+	tlsCert := flag.String("tls-cert", "", "path to a TLS certificate; serves HTTPS using this static certificate and --tls-key")
+	tlsKey := flag.String("tls-key", "", "path to the TLS certificate's private key, used with --tls-cert")
+	acmeDomain := flag.String("acme-domain", "", "domain name to provision a TLS certificate for automatically via Let's Encrypt; takes precedence over --tls-cert")
+	acmeEmail := flag.String("acme-email", "", "contact email registered with Let's Encrypt when using --acme-domain")
+	acmeCacheDir := flag.String("acme-cache-dir", "/tmp/http_test_server_acme_cache", "directory where --acme-domain certificates are cached between runs")
+	flag.Parse()
+
+	server := NewServer(ServerConfig{
+		Address:      *address,
+		ESMode:       *esMode,
+		ESVersion:    *esVersion,
+		ProfilePath:  *profile,
+		TLSCertPath:  *tlsCert,
+		TLSKeyPath:   *tlsKey,
+		ACMEDomain:   *acmeDomain,
+		ACMEEmail:    *acmeEmail,
+		ACMECacheDir: *acmeCacheDir,
+	})
+	server.Listen()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// counterSet is the per-content-type message/byte breakdown backing both
+// the JSON summary and the /_metrics exposition.
+type counterSet struct {
+	MessageCount int64 `json:"message_count"`
+	ByteTotal    int64 `json:"byte_total"`
+}
+
+// requestLabels identifies one series of the requests_total counter.
+type requestLabels struct {
+	path        string
+	method      string
+	status      string
+	contentType string
+}
+
+// defaultDurationBuckets mirrors the Prometheus client libraries' default
+// histogram buckets (seconds), which comfortably cover the sub-10s
+// latencies this server's own fault-injection profiles can introduce.
+var defaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is a minimal Prometheus-compatible cumulative histogram. It
+// is guarded by a single mutex rather than lock-free atomics since this
+// server prioritizes simplicity over raw throughput.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe records one sample, incrementing every bucket whose upper
+// bound is at or above it so counts are already cumulative at read time.
+func (h *Histogram) Observe(seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// WriteTo renders the histogram in Prometheus text exposition format
+// under the given metric name.
+func (h *Histogram) WriteTo(w http.ResponseWriter, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// contentTypeCounters returns (creating if needed) the counterSet for a
+// content type, normalizing the empty header to "unknown".
+func (s *Server) contentTypeCounters(contentType string) *counterSet {
+	if contentType == "" {
+		contentType = "unknown"
+	}
+
+	if v, ok := s.byContentType.Load(contentType); ok {
+		return v.(*counterSet)
+	}
+
+	cs, _ := s.byContentType.LoadOrStore(contentType, &counterSet{})
+	return cs.(*counterSet)
+}
+
+// snapshotContentTypes copies the live per-content-type counters for
+// inclusion in the JSON summary.
+func (s *Server) snapshotContentTypes() map[string]counterSet {
+	out := make(map[string]counterSet)
+	s.byContentType.Range(func(k, v interface{}) bool {
+		cs := v.(*counterSet)
+		out[k.(string)] = counterSet{
+			MessageCount: atomic.LoadInt64(&cs.MessageCount),
+			ByteTotal:    atomic.LoadInt64(&cs.ByteTotal),
+		}
+		return true
+	})
+	return out
+}
+
+// recordRequest tallies one completed request into requests_total and
+// the request_duration_seconds histogram.
+func (s *Server) recordRequest(path, method string, status int, contentType string, duration float64) {
+	if contentType == "" {
+		contentType = "unknown"
+	}
+
+	labels := requestLabels{path: path, method: method, status: strconv.Itoa(status), contentType: contentType}
+	if v, ok := s.requestCounters.Load(labels); ok {
+		atomic.AddInt64(v.(*int64), 1)
+	} else {
+		n := new(int64)
+		*n = 1
+		actual, loaded := s.requestCounters.LoadOrStore(labels, n)
+		if loaded {
+			atomic.AddInt64(actual.(*int64), 1)
+		}
+	}
+
+	s.requestDuration.Observe(duration)
+}
+
+// Metrics renders a Prometheus text-format exposition of the server's
+// live counters and latency histogram, broken down by content type so a
+// single target shared across NDJSON, plain text, and ES bulk clients
+// reports volume per format.
+func (s *Server) Metrics() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintln(w, "# HELP http_test_server_requests_total Total HTTP requests received.")
+		fmt.Fprintln(w, "# TYPE http_test_server_requests_total counter")
+		s.requestCounters.Range(func(k, v interface{}) bool {
+			labels := k.(requestLabels)
+			fmt.Fprintf(w, "http_test_server_requests_total{path=%q,method=%q,status=%q,content_type=%q} %d\n",
+				labels.path, labels.method, labels.status, labels.contentType, atomic.LoadInt64(v.(*int64)))
+			return true
+		})
+
+		contentTypes := s.snapshotContentTypes()
+
+		fmt.Fprintln(w, "# HELP http_test_server_messages_total Ingested messages, by content type.")
+		fmt.Fprintln(w, "# TYPE http_test_server_messages_total counter")
+		for contentType, cs := range contentTypes {
+			fmt.Fprintf(w, "http_test_server_messages_total{content_type=%q} %d\n", contentType, cs.MessageCount)
+		}
+
+		fmt.Fprintln(w, "# HELP http_test_server_bytes_total Ingested bytes, by content type.")
+		fmt.Fprintln(w, "# TYPE http_test_server_bytes_total counter")
+		for contentType, cs := range contentTypes {
+			fmt.Fprintf(w, "http_test_server_bytes_total{content_type=%q} %d\n", contentType, cs.ByteTotal)
+		}
+
+		fmt.Fprintln(w, "# HELP http_test_server_request_duration_seconds Request handling latency.")
+		fmt.Fprintln(w, "# TYPE http_test_server_request_duration_seconds histogram")
+		s.requestDuration.WriteTo(w, "http_test_server_request_duration_seconds")
+	})
+}
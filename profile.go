@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile lets a caller script the server's behavior instead of it always
+// returning 204, so log shippers' retry/backoff paths can be exercised
+// without a custom mock. Rules are evaluated in order; the first one that
+// matches the request and has been triggered by its match count wins.
+type Profile struct {
+	Rules []ProfileRule `json:"rules" yaml:"rules"`
+}
+
+// ProfileRule describes one scripted response. Path is matched with
+// path.Match semantics (e.g. "/_bulk" or "/*/_bulk"); an empty Path or
+// Method matches anything. OnMatch is the 1-indexed match count the rule
+// starts applying at (default 1, i.e. every matching request); Repeat
+// bounds how many consecutive matches it stays active for (0 means
+// forever once triggered).
+type ProfileRule struct {
+	Path    string `json:"path" yaml:"path"`
+	Method  string `json:"method" yaml:"method"`
+	OnMatch int    `json:"on_match" yaml:"on_match"`
+	Repeat  int    `json:"repeat" yaml:"repeat"`
+
+	Status                 int               `json:"status,omitempty" yaml:"status,omitempty"`
+	Body                   string            `json:"body,omitempty" yaml:"body,omitempty"`
+	Headers                map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	LatencyMinMS           int               `json:"latency_min_ms,omitempty" yaml:"latency_min_ms,omitempty"`
+	LatencyMaxMS           int               `json:"latency_max_ms,omitempty" yaml:"latency_max_ms,omitempty"`
+	CloseConnection        bool              `json:"close_connection,omitempty" yaml:"close_connection,omitempty"`
+	SlowDripBytesPerSecond int               `json:"slow_drip_bytes_per_second,omitempty" yaml:"slow_drip_bytes_per_second,omitempty"`
+}
+
+// matches reports whether the rule's path glob and method apply to r.
+func (rule *ProfileRule) matches(r *http.Request) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+
+	if rule.Path == "" {
+		return true
+	}
+
+	ok, err := path.Match(rule.Path, r.URL.Path)
+	return err == nil && ok
+}
+
+// triggered reports whether the rule should apply on its nth match.
+func (rule *ProfileRule) triggered(n int64) bool {
+	onMatch := rule.OnMatch
+	if onMatch <= 0 {
+		onMatch = 1
+	}
+
+	if n < int64(onMatch) {
+		return false
+	}
+
+	if rule.Repeat <= 0 {
+		return true
+	}
+
+	return n < int64(onMatch+rule.Repeat)
+}
+
+// apply executes the rule's scripted actions against w.
+func (rule *ProfileRule) apply(w http.ResponseWriter) {
+	for k, v := range rule.Headers {
+		w.Header().Set(k, v)
+	}
+
+	if rule.LatencyMinMS > 0 || rule.LatencyMaxMS > 0 {
+		time.Sleep(rule.sampleLatency())
+	}
+
+	if rule.CloseConnection {
+		hijackAndClose(w)
+		return
+	}
+
+	if rule.SlowDripBytesPerSecond > 0 {
+		slowDrip(w, []byte(rule.Body), rule.SlowDripBytesPerSecond)
+		return
+	}
+
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusNoContent
+	}
+	w.WriteHeader(status)
+	if rule.Body != "" {
+		w.Write([]byte(rule.Body))
+	}
+}
+
+// sampleLatency picks a latency uniformly between LatencyMinMS and
+// LatencyMaxMS, tolerating either being left unset.
+func (rule *ProfileRule) sampleLatency() time.Duration {
+	min, max := rule.LatencyMinMS, rule.LatencyMaxMS
+	if max < min {
+		min, max = max, min
+	}
+	if max <= 0 {
+		return 0
+	}
+
+	ms := min
+	if max > min {
+		ms += rand.Intn(max - min + 1)
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
+
+// hijackAndClose drops the connection mid-response to simulate a peer
+// that disappears without a well-formed response.
+func hijackAndClose(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+// slowDrip writes body in bytesPerSecond-sized chunks, one chunk a
+// second, to emulate a slow/flaky upstream.
+func slowDrip(w http.ResponseWriter, body []byte, bytesPerSecond int) {
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	for len(body) > 0 {
+		n := bytesPerSecond
+		if n > len(body) {
+			n = len(body)
+		}
+
+		w.Write(body[:n])
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		body = body[n:]
+		if len(body) > 0 {
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+
+// loadedProfile pairs an immutable Profile with the match counters
+// accumulated against it, so swapping the active profile also resets
+// where each endpoint's match count stands. Rules that share a Path and
+// Method describe successive phases of the same scripted endpoint (e.g.
+// "429 for requests 5-7, then a partial-failure response forever after"),
+// so they share one counter keyed on that pair rather than each rule
+// counting independently.
+type loadedProfile struct {
+	profile Profile
+	state   []*int64 // parallel to profile.Rules
+}
+
+// ProfileManager holds the currently active Profile and lets it be
+// swapped atomically, either at startup (--profile) or at runtime
+// (POST /_control/profile).
+type ProfileManager struct {
+	current atomic.Value // *loadedProfile
+}
+
+func NewProfileManager() *ProfileManager {
+	pm := &ProfileManager{}
+	pm.Store(Profile{})
+	return pm
+}
+
+func (pm *ProfileManager) Store(profile Profile) {
+	counters := make(map[string]*int64)
+	state := make([]*int64, len(profile.Rules))
+
+	for i, rule := range profile.Rules {
+		key := rule.Path + "\x00" + strings.ToUpper(rule.Method)
+		if counters[key] == nil {
+			counters[key] = new(int64)
+		}
+		state[i] = counters[key]
+	}
+
+	pm.current.Store(&loadedProfile{profile: profile, state: state})
+}
+
+func (pm *ProfileManager) load() *loadedProfile {
+	return pm.current.Load().(*loadedProfile)
+}
+
+// LoadFile reads a Profile from a YAML (.yaml/.yml) or JSON file and
+// makes it the active profile.
+func (pm *ProfileManager) LoadFile(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var profile Profile
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		err = yaml.Unmarshal(raw, &profile)
+	} else {
+		err = json.Unmarshal(raw, &profile)
+	}
+	if err != nil {
+		return err
+	}
+
+	pm.Store(profile)
+	return nil
+}
+
+// Middleware evaluates the active profile's rules against every request,
+// letting a triggered rule fully handle the response instead of passing
+// it on to next.
+func (pm *ProfileManager) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lp := pm.load()
+			seen := make(map[*int64]int64)
+
+			for i := range lp.profile.Rules {
+				rule := &lp.profile.Rules[i]
+				if !rule.matches(r) {
+					continue
+				}
+
+				n, ok := seen[lp.state[i]]
+				if !ok {
+					n = atomic.AddInt64(lp.state[i], 1)
+					seen[lp.state[i]] = n
+				}
+
+				if !rule.triggered(n) {
+					continue
+				}
+
+				rule.apply(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ControlProfile handles POST /_control/profile, atomically swapping the
+// active profile from a JSON request body.
+func (s *Server) ControlProfile() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var profile Profile
+		if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+			s.logger.Printf("Error decoding profile: %v", err)
+			http.Error(w, "invalid profile", http.StatusBadRequest)
+			return
+		}
+
+		s.profiles.Store(profile)
+		s.logger.Printf("Swapped active profile (%d rules)", len(profile.Rules))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+// TestProfileRuleTriggered locks in the on_match/repeat phase sequencing
+// the per-endpoint shared counter relies on (see loadedProfile).
+func TestProfileRuleTriggered(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ProfileRule
+		matches map[int64]bool // match count -> expected triggered
+	}{
+		{
+			name: "default fires on every match",
+			rule: ProfileRule{},
+			matches: map[int64]bool{
+				1: true,
+				2: true,
+				3: true,
+			},
+		},
+		{
+			name: "on_match delays the first fire",
+			rule: ProfileRule{OnMatch: 3},
+			matches: map[int64]bool{
+				1: false,
+				2: false,
+				3: true,
+				4: true,
+			},
+		},
+		{
+			name: "repeat bounds how long it stays active",
+			rule: ProfileRule{OnMatch: 2, Repeat: 2},
+			matches: map[int64]bool{
+				1: false,
+				2: true,
+				3: true,
+				4: false,
+				5: false,
+			},
+		},
+		{
+			name: "repeat with default on_match",
+			rule: ProfileRule{Repeat: 1},
+			matches: map[int64]bool{
+				1: true,
+				2: false,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for n, want := range tt.matches {
+				if got := tt.rule.triggered(n); got != want {
+					t.Errorf("triggered(%d) = %v, want %v", n, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// listenerFDEnv carries the inherited listening socket's file descriptor
+// number across a re-exec, mirroring the systemd socket-activation
+// conventions (LISTEN_FDS/LISTEN_PID) honored below.
+const listenerFDEnv = "HTTP_TEST_SERVER_LISTENER_FD"
+
+// readyFDEnv carries the file descriptor number of a pipe the replacement
+// process writes to once it has taken over the handed-off listener and is
+// ready to serve. reexec waits on its end of this pipe rather than probing
+// an address, since the old process is still serving that same address
+// (and would answer the probe itself) until the handoff completes.
+const readyFDEnv = "HTTP_TEST_SERVER_READY_FD"
+
+// sdListenFDsStart is the first inherited descriptor under the systemd
+// socket-activation protocol.
+const sdListenFDsStart = 3
+
+// newListener builds the listener Server.Listen will serve on, preferring
+// (in order) an explicitly inherited fd from a graceful restart, a
+// systemd-activated socket, and finally a fresh net.Listen.
+func newListener(address string) (net.Listener, error) {
+	if fd, ok := inheritedListenerFD(); ok {
+		return net.FileListener(os.NewFile(fd, "http_test_server-listener"))
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// inheritedListenerFD looks for a socket handed down either by a prior
+// invocation of this process (HTTP_TEST_SERVER_LISTENER_FD, set by
+// reexec below) or by systemd socket activation (LISTEN_FDS/LISTEN_PID).
+func inheritedListenerFD() (uintptr, bool) {
+	if raw := os.Getenv(listenerFDEnv); raw != "" {
+		fd, err := strconv.Atoi(raw)
+		if err == nil {
+			return uintptr(fd), true
+		}
+	}
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+		if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err == nil && n >= 1 {
+			return uintptr(sdListenFDsStart), true
+		}
+	}
+
+	return 0, false
+}
+
+// reexec performs a live, zero-downtime restart: it hands the listening
+// socket to a freshly exec'd copy of this process, waits for that copy to
+// signal readiness over a dedicated pipe, and returns nil only once it has;
+// shutting the current process down is left to the caller (Listen's signal
+// loop). It is triggered by SIGHUP/SIGUSR2 so long-running load tests
+// survive a config or binary change.
+func (s *Server) reexec() error {
+	tcpListener, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("listener of type %T does not support fd handoff", s.listener)
+	}
+
+	listenerFile, err := tcpListener.File()
+	if err != nil {
+		return fmt.Errorf("getting listener fd: %w", err)
+	}
+	defer listenerFile.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("creating readiness pipe: %w", err)
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{listenerFile, readyWriter}
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenerFDEnv, sdListenFDsStart),
+		fmt.Sprintf("%s=%d", readyFDEnv, sdListenFDsStart+1),
+	)
+
+	if err := cmd.Start(); err != nil {
+		readyWriter.Close()
+		return fmt.Errorf("starting replacement process: %w", err)
+	}
+
+	// Close our copy of the write end. Once the child's copy is also gone
+	// - because it signaled ready, or because it exited - the read below
+	// unblocks instead of waiting on a descriptor only we still hold open.
+	readyWriter.Close()
+
+	if err := waitReady(readyReader, 30*time.Second); err != nil {
+		return fmt.Errorf("replacement process never signaled ready: %w", err)
+	}
+
+	s.logger.Printf("Replacement process (pid %d) is healthy, handing off", cmd.Process.Pid)
+	return nil
+}
+
+// waitReady blocks until the replacement process writes to its end of the
+// readiness pipe, or returns an error if it closes the pipe first (e.g. it
+// crashed during startup) or the timeout elapses. Unlike probing /_health
+// over the network, this can't be mistakenly answered by the old process,
+// which is still serving the shared listener fd while this runs.
+func waitReady(readyReader *os.File, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyReader.Read(buf)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("pipe closed before signaling ready: %w", err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// signalReady tells a parent process that handed this one a listener via
+// reexec that it is now serving and ready to take over traffic. It is a
+// no-op when this process is not the replacement side of a restart.
+func signalReady() {
+	raw := os.Getenv(readyFDEnv)
+	if raw == "" {
+		return
+	}
+
+	fd, err := strconv.Atoi(raw)
+	if err != nil {
+		return
+	}
+
+	readyWriter := os.NewFile(uintptr(fd), "http_test_server-ready")
+	defer readyWriter.Close()
+	readyWriter.Write([]byte{1})
+}
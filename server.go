@@ -6,10 +6,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -36,38 +37,108 @@ type ESMeta struct {
 }
 
 type Server struct {
-	address      string
-	ByteTotal    int64 `json:"byte_total"`
-	file         *os.File
-	FirstMessage string `json:"first_message"`
-	LastMessage  string `json:"last_message"`
-	logger       *log.Logger
-	MessageCount int64 `json:"message_count"`
-	RequestCount int64 `json:"request_count"`
-	server       *http.Server
+	acmeCacheDir    string
+	acmeDomain      string
+	acmeEmail       string
+	acmeServer      *http.Server
+	address         string
+	ByteTotal       int64 `json:"byte_total"`
+	esMode          bool
+	esVersion       string
+	file            *os.File
+	FirstMessage    string `json:"first_message"`
+	LastMessage     string `json:"last_message"`
+	listener        net.Listener
+	logger          *log.Logger
+	byContentType   sync.Map // content type -> *counterSet
+	MessageCount    int64    `json:"message_count"`
+	mu              sync.Mutex
+	profiles        *ProfileManager
+	requestCounters sync.Map // requestLabels -> *int64
+	requestDuration *Histogram
+	RequestCount    int64 `json:"request_count"`
+	server          *http.Server
+	tlsCertPath     string
+	tlsKeyPath      string
+}
+
+// ServerConfig collects Server's construction parameters. It grew from a
+// handful of positional arguments into this struct once the TLS and ACME
+// flags pushed the count past what's comfortable to read positionally.
+type ServerConfig struct {
+	Address      string
+	ESMode       bool
+	ESVersion    string
+	ProfilePath  string
+	TLSCertPath  string
+	TLSKeyPath   string
+	ACMEDomain   string
+	ACMEEmail    string
+	ACMECacheDir string
 }
 
 func (s *Server) Listen() {
-	var gracefulStop = make(chan os.Signal)
+	listener, err := newListener(s.address)
+	if err != nil {
+		s.logger.Fatalf("Could not listen on %s: %v\n", s.address, err)
+	}
+	s.listener = listener
+
+	gracefulStop := make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
 
-	go func() {
-		sig := <-gracefulStop
-		s.logger.Printf("Caught sig: %+v", sig)
+	restartSignal := make(chan os.Signal, 1)
+	signal.Notify(restartSignal, syscall.SIGHUP)
+	signal.Notify(restartSignal, syscall.SIGUSR2)
 
+	if s.acmeDomain != "" {
+		s.acmeServer = configureACME(s.server, s.acmeDomain, s.acmeEmail, s.acmeCacheDir)
+	}
+
+	shutdown := func() {
 		s.WriteSummary()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
-		s.server.SetKeepAlivesEnabled(false)
-		if err := s.server.Shutdown(ctx); err != nil {
-			s.logger.Fatalf("Could not gracefully shutdown the server: %v\n", err)
+		servers := []*http.Server{s.server}
+		if s.acmeServer != nil {
+			servers = append(servers, s.acmeServer)
 		}
 
+		var wg sync.WaitGroup
+		wg.Add(len(servers))
+		for _, server := range servers {
+			go func(server *http.Server) {
+				defer wg.Done()
+				server.SetKeepAlivesEnabled(false)
+				if err := server.Shutdown(ctx); err != nil {
+					s.logger.Printf("Could not gracefully shut down %s: %v", server.Addr, err)
+				}
+			}(server)
+		}
+		wg.Wait()
+
 		s.logger.Println("Server stopped")
 		os.Exit(0)
+	}
+
+	go func() {
+		for {
+			select {
+			case sig := <-gracefulStop:
+				s.logger.Printf("Caught sig: %+v", sig)
+				shutdown()
+			case sig := <-restartSignal:
+				s.logger.Printf("Caught sig: %+v, restarting with socket handoff", sig)
+				if err := s.reexec(); err != nil {
+					s.logger.Printf("Could not hand off to a replacement process, staying up: %v", err)
+					continue
+				}
+				shutdown()
+			}
+		}
 	}()
 
 	// Print debug output on an interval. This helps with providing insight
@@ -78,7 +149,7 @@ func (s *Server) Listen() {
 		for {
 			select {
 			case <-ticker.C:
-				log.Printf("Received %v messages across %v requests", s.MessageCount, s.RequestCount)
+				log.Printf("Received %v messages across %v requests", atomic.LoadInt64(&s.MessageCount), atomic.LoadInt64(&s.RequestCount))
 			case <-quit:
 				ticker.Stop()
 				return
@@ -86,15 +157,57 @@ func (s *Server) Listen() {
 		}
 	}()
 
+	if s.acmeServer != nil {
+		go func() {
+			s.logger.Println("ACME HTTP-01 challenge responder is ready at", s.acmeServer.Addr)
+			if err := s.acmeServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.Printf("ACME challenge responder stopped: %v", err)
+			}
+		}()
+	}
+
 	s.logger.Println("Server is ready to handle requests at", s.address)
 	atomic.StoreInt32(&healthy, 1)
-	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		s.logger.Fatalf("Could not listen on %s: %v\n", s.address, err)
+	signalReady()
+
+	var serveErr error
+	switch {
+	case s.acmeDomain != "":
+		serveErr = s.server.ServeTLS(listener, "", "")
+	case s.tlsCertPath != "":
+		serveErr = s.server.ServeTLS(listener, s.tlsCertPath, s.tlsKeyPath)
+	default:
+		serveErr = s.server.Serve(listener)
+	}
+	if serveErr != nil && serveErr != http.ErrServerClosed {
+		s.logger.Fatalf("Could not serve on %s: %v\n", s.address, serveErr)
 	}
 }
 
 func (s *Server) WriteSummary() {
-	sBytes, err := json.Marshal(s)
+	type summaryDoc struct {
+		ByteTotal    int64                 `json:"byte_total"`
+		FirstMessage string                `json:"first_message"`
+		LastMessage  string                `json:"last_message"`
+		MessageCount int64                 `json:"message_count"`
+		RequestCount int64                 `json:"request_count"`
+		ContentTypes map[string]counterSet `json:"content_types"`
+	}
+
+	s.mu.Lock()
+	firstMessage, lastMessage := s.FirstMessage, s.LastMessage
+	s.mu.Unlock()
+
+	doc := summaryDoc{
+		ByteTotal:    atomic.LoadInt64(&s.ByteTotal),
+		FirstMessage: firstMessage,
+		LastMessage:  lastMessage,
+		MessageCount: atomic.LoadInt64(&s.MessageCount),
+		RequestCount: atomic.LoadInt64(&s.RequestCount),
+		ContentTypes: s.snapshotContentTypes(),
+	}
+
+	sBytes, err := json.Marshal(doc)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -109,57 +222,69 @@ func (s *Server) WriteSummary() {
 
 func (s *Server) Index() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		s.RequestCount++
+		atomic.AddInt64(&s.RequestCount, 1)
 
 		contentType := r.Header.Get("Content-Type")
 		contentLength := r.Header.Get("Content-Length")
 		s.logger.Printf("Received request: content-type: %v, content-length: %v", contentType, contentLength)
 
-		bodyBytes, err := ioutil.ReadAll(r.Body)
-		if err != nil {
+		if err := s.ingest(contentType, r.Body); err != nil {
 			s.logger.Printf("Error reading body: %v", err)
 			http.Error(w, "can't read body", http.StatusBadRequest)
 			return
 		}
 
-		byteLen := len(bodyBytes)
-		body := string(bodyBytes)
-		messages := []string{}
-
-		switch contentType {
-		// Unfortunately fluentbit does not use the proper content type when sending
-		// new line delimited JSON :(
-		case "application/json":
-			messages = strings.Split(body, "\n")
-		case "application/ndjson":
-			messages = strings.Split(body, "\n")
-		case "application/x-ndjson":
-			messages = strings.Split(body, "\n")
-		case "text/plain":
-			messages = strings.Split(body, "\n")
-		}
-
-		messageCount := len(messages)
+		w.WriteHeader(http.StatusNoContent)
+		fmt.Fprintln(w, "")
+	})
+}
 
-		if messageCount > 0 {
-			s.ByteTotal = s.ByteTotal + int64(byteLen)
-			s.MessageCount = s.MessageCount + int64(messageCount)
+// statusRecorder wraps a ResponseWriter to capture the status code
+// eventually written, for the requests_total metric's status label.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
-			firstMessage := messages[0]
-			lastMessage := messages[messageCount-1]
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
 
-			if s.FirstMessage == "" && firstMessage != "" {
-				s.FirstMessage = messages[0]
-			}
+// recordMessage folds a single ingested message into the running
+// counters, both the aggregate ones and the contentType breakdown. It is
+// shared by the streaming NDJSON ingestion path and the --es-mode
+// bulk/doc handlers so both report volume the same way; bulk callers
+// only pass document lines (skipping action metadata lines) so
+// MessageCount reflects documents, not bulk directives. Counters are
+// mutated with atomic.AddInt64 and the string fields under s.mu since
+// handler invocations run concurrently.
+func (s *Server) recordMessage(contentType, message string) {
+	atomic.AddInt64(&s.ByteTotal, int64(len(message)))
+	atomic.AddInt64(&s.MessageCount, 1)
+
+	cs := s.contentTypeCounters(contentType)
+	atomic.AddInt64(&cs.ByteTotal, int64(len(message)))
+	atomic.AddInt64(&cs.MessageCount, 1)
+
+	if message == "" {
+		return
+	}
 
-			if lastMessage != "" {
-				s.LastMessage = lastMessage
-			}
-		}
+	s.mu.Lock()
+	if s.FirstMessage == "" {
+		s.FirstMessage = message
+	}
+	s.LastMessage = message
+	s.mu.Unlock()
+}
 
-		w.WriteHeader(http.StatusNoContent)
-		fmt.Fprintln(w, "")
-	})
+// recordBatch records a batch of messages collected up front, e.g. by the
+// --es-mode bulk handler which still buffers the whole request body.
+func (s *Server) recordBatch(contentType string, messages []string) {
+	for _, message := range messages {
+		s.recordMessage(contentType, message)
+	}
 }
 
 func (s *Server) Health() http.Handler {
@@ -172,53 +297,91 @@ func (s *Server) Health() http.Handler {
 	})
 }
 
-func NewServer(address string) *Server {
+func NewServer(config ServerConfig) *Server {
 	os.Remove(summaryPath)
 
 	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
 	logger.Println("Server is starting...")
 
 	router := http.NewServeMux()
+	profiles := NewProfileManager()
 
 	nextRequestID := func() string {
 		return fmt.Sprintf("%d", time.Now().UnixNano())
 	}
 
+	server := &Server{
+		acmeCacheDir:    config.ACMECacheDir,
+		acmeDomain:      config.ACMEDomain,
+		acmeEmail:       config.ACMEEmail,
+		address:         config.Address,
+		ByteTotal:       0,
+		esMode:          config.ESMode,
+		esVersion:       config.ESVersion,
+		logger:          logger,
+		MessageCount:    0,
+		profiles:        profiles,
+		requestDuration: newHistogram(defaultDurationBuckets),
+		RequestCount:    0,
+		tlsCertPath:     config.TLSCertPath,
+		tlsKeyPath:      config.TLSKeyPath,
+	}
+
 	httpServer := &http.Server{
-		Addr:         address,
-		Handler:      tracing(nextRequestID)(logging(logger)(router)),
+		Addr:         config.Address,
+		Handler:      tracing(nextRequestID)(profiles.Middleware()(server.logging()(router))),
 		ErrorLog:     logger,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  15 * time.Second,
 	}
+	server.server = httpServer
 
-	server := &Server{
-		address:      address,
-		ByteTotal:    0,
-		logger:       logger,
-		MessageCount: 0,
-		RequestCount: 0,
-		server:       httpServer,
+	if config.ProfilePath != "" {
+		if err := profiles.LoadFile(config.ProfilePath); err != nil {
+			logger.Fatalf("Could not load profile %s: %v\n", config.ProfilePath, err)
+		}
+		logger.Printf("Loaded response profile from %s", config.ProfilePath)
 	}
 
-	router.Handle("/", server.Index())
+	switch {
+	case config.ACMEDomain != "":
+		logger.Printf("Provisioning TLS certificates automatically via ACME for %s", config.ACMEDomain)
+	case config.TLSCertPath != "":
+		logger.Printf("Serving TLS using certificate %s", config.TLSCertPath)
+	}
+
+	if config.ESMode {
+		logger.Printf("Running in Elasticsearch emulation mode (version %s)", config.ESVersion)
+		router.Handle("/", server.ElasticsearchRouter())
+	} else {
+		router.Handle("/", server.Index())
+	}
 	router.Handle("/_health", server.Health())
+	router.Handle("/_control/profile", server.ControlProfile())
+	router.Handle("/_metrics", server.Metrics())
 
 	return server
 }
 
-func logging(logger *log.Logger) func(http.Handler) http.Handler {
+// logging logs each request and, on the way out, records it into the
+// requests_total counter and request_duration_seconds histogram exposed
+// at /_metrics.
+func (s *Server) logging() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
 			defer func() {
 				requestID, ok := r.Context().Value(requestIDKey).(string)
 				if !ok {
 					requestID = "unknown"
 				}
-				logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+				s.logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+				s.recordRequest(r.URL.Path, r.Method, rec.status, r.Header.Get("Content-Type"), time.Since(start).Seconds())
 			}()
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(rec, r)
 		})
 	}
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeHTTPAddress is where the ACME HTTP-01 challenge responder (and the
+// plain-HTTP-to-HTTPS redirect) listens; autocert only ever validates
+// challenges on port 80.
+const acmeHTTPAddress = ":80"
+
+// configureACME builds an autocert.Manager for the given domain, points
+// the main server's TLSConfig at its GetCertificate, and returns the
+// second http.Server that answers HTTP-01 challenges on :80 and redirects
+// everything else to HTTPS.
+func configureACME(httpsServer *http.Server, domain, email, cacheDir string) *http.Server {
+	certManager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domain),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+
+	httpsServer.TLSConfig = &tls.Config{GetCertificate: certManager.GetCertificate}
+
+	return &http.Server{
+		Addr:    acmeHTTPAddress,
+		Handler: certManager.HTTPHandler(nil),
+	}
+}